@@ -0,0 +1,40 @@
+// deputize - Update an LDAP group with info from the PagerDuty API
+// main.go: Entry point
+//
+// Copyright 2017 Threat Stack, Inc. All rights reserved.
+// Author: Patrick T. Cable II <pat.cable@threatstack.com>
+
+package main
+
+import (
+  "flag"
+  "fmt"
+  "github.com/gjmf/deputize/oncall"
+  "os"
+  "time"
+)
+
+func main() {
+  if len(os.Args) > 1 && os.Args[1] == "serve" {
+    serveFlags := flag.NewFlagSet("serve", flag.ExitOnError)
+    interval := serveFlags.Duration("interval", 11*time.Hour+30*time.Minute, "how often to sync the on-call rotation")
+    metricsAddr := serveFlags.String("metrics-addr", ":9090", "address to serve /metrics, /healthz, and /readyz on")
+    force := serveFlags.Bool("force", false, "ignore any saved sync state on the first run")
+    serveFlags.Parse(os.Args[2:])
+
+    err := oncall.Serve(oncall.ServeConfig{Interval: *interval, MetricsAddr: *metricsAddr, Force: *force})
+    if err != nil {
+      fmt.Fprintln(os.Stderr, err)
+      os.Exit(1)
+    }
+    return
+  }
+
+  force := flag.Bool("force", false, "ignore any saved sync state")
+  flag.Parse()
+
+  if err := oncall.UpdateOnCallRotation(*force); err != nil {
+    fmt.Fprintln(os.Stderr, err)
+    os.Exit(1)
+  }
+}
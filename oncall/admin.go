@@ -0,0 +1,222 @@
+// deputize - Update an LDAP group with info from the PagerDuty API
+// admin.go: JWT-protected admin HTTP API for the daemon
+//
+// Copyright 2017 Threat Stack, Inc. All rights reserved.
+// Author: Patrick T. Cable II <pat.cable@threatstack.com>
+
+package oncall
+
+import (
+  "context"
+  "crypto/rsa"
+  "encoding/base64"
+  "encoding/json"
+  "fmt"
+  "github.com/golang-jwt/jwt/v4"
+  "math/big"
+  "net/http"
+  "strings"
+  "sync"
+  "time"
+)
+
+// AdminAPIConfig configures the optional admin HTTP API started alongside
+// the daemon's metrics server. Tokens are verified against JWTHS256Secret
+// if set, otherwise against an RS256 key fetched from JWTJWKSURL.
+type AdminAPIConfig struct {
+  Addr string
+  JWTHS256Secret string
+  JWTJWKSURL string
+}
+
+// scheduleStatus is what GET /v1/schedules reports for a single schedule.
+type scheduleStatus struct {
+  Name string `json:"name"`
+  Members []string `json:"last_known_members"`
+}
+
+// newAdminAPIMux builds the admin API's handler. config and stateStore are
+// used to answer GET /v1/oncall and GET /v1/schedules from the same
+// persisted SyncState UpdateOnCallRotation writes; rotate triggers an
+// immediate sync for POST /v1/rotate.
+func newAdminAPIMux(apiConfig AdminAPIConfig, config DeputizeConfig, stateStore StateStore, rotate func() error) (http.Handler, error) {
+  verify, err := newJWTVerifier(apiConfig)
+  if err != nil {
+    return nil, err
+  }
+
+  mux := http.NewServeMux()
+
+  mux.HandleFunc("/v1/rotate", verify(func(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+      http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+      return
+    }
+    if err := rotate(); err != nil {
+      http.Error(w, err.Error(), http.StatusInternalServerError)
+      return
+    }
+    w.WriteHeader(http.StatusAccepted)
+  }))
+
+  mux.HandleFunc("/v1/oncall", verify(func(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+      http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+      return
+    }
+    state, err := stateStore.Load()
+    if err != nil {
+      http.Error(w, err.Error(), http.StatusInternalServerError)
+      return
+    }
+    var onCall []string
+    if state != nil {
+      for _, uids := range state.ScheduleUids {
+        onCall = append(onCall, uids...)
+      }
+      onCall = removeDuplicates(onCall)
+    }
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(onCall)
+  }))
+
+  mux.HandleFunc("/v1/schedules", verify(func(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+      http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+      return
+    }
+    state, err := stateStore.Load()
+    if err != nil {
+      http.Error(w, err.Error(), http.StatusInternalServerError)
+      return
+    }
+    schedules := make([]scheduleStatus, 0, len(config.OnCallSchedules))
+    for _, name := range config.OnCallSchedules {
+      var members []string
+      if state != nil {
+        members = state.ScheduleUids[name]
+      }
+      schedules = append(schedules, scheduleStatus{Name: name, Members: members})
+    }
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(schedules)
+  }))
+
+  return mux, nil
+}
+
+// newJWTVerifier builds middleware that reads the "Authorization: Bearer
+// ..." header, verifies the token, and rejects the request with 401 if it
+// doesn't check out. This mirrors the usual Go pattern of layering JWT
+// onto handlers: verify, stash the claims on the request context, then
+// call through - downstream handlers read claims via ClaimsFromContext
+// for any authz decisions of their own.
+func newJWTVerifier(apiConfig AdminAPIConfig) (func(http.HandlerFunc) http.HandlerFunc, error) {
+  if apiConfig.JWTHS256Secret == "" && apiConfig.JWTJWKSURL == "" {
+    return nil, fmt.Errorf("Admin API requires either a JWT HS256 secret or a JWKS URL")
+  }
+
+  keyFunc := func(token *jwt.Token) (interface{}, error) {
+    if apiConfig.JWTHS256Secret != "" {
+      if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+        return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+      }
+      return []byte(apiConfig.JWTHS256Secret), nil
+    }
+    if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
+      return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+    }
+    kid, _ := token.Header["kid"].(string)
+    return fetchJWKSKey(apiConfig.JWTJWKSURL, kid)
+  }
+
+  return func(next http.HandlerFunc) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+      authHeader := r.Header.Get("Authorization")
+      if !strings.HasPrefix(authHeader, "Bearer ") {
+        http.Error(w, "missing bearer token", http.StatusUnauthorized)
+        return
+      }
+
+      claims := jwt.MapClaims{}
+      token, err := jwt.ParseWithClaims(strings.TrimPrefix(authHeader, "Bearer "), claims, keyFunc)
+      if err != nil || !token.Valid {
+        http.Error(w, "invalid token", http.StatusUnauthorized)
+        return
+      }
+
+      next(w, r.WithContext(context.WithValue(r.Context(), claimsContextKey, claims)))
+    }
+  }, nil
+}
+
+type contextKey string
+
+const claimsContextKey contextKey = "deputize-jwt-claims"
+
+// ClaimsFromContext returns the JWT claims the admin API's auth middleware
+// verified and attached to the request context.
+func ClaimsFromContext(ctx context.Context) (jwt.MapClaims, bool) {
+  claims, ok := ctx.Value(claimsContextKey).(jwt.MapClaims)
+  return claims, ok
+}
+
+type jwksKeySet struct {
+  Keys []struct {
+    Kid string `json:"kid"`
+    N string `json:"n"`
+    E string `json:"e"`
+  } `json:"keys"`
+}
+
+var jwksCacheMu sync.Mutex
+var jwksCache = map[string]jwksKeySet{}
+var jwksCacheExpiry = map[string]time.Time{}
+
+// fetchJWKSKey fetches (and caches for ten minutes) the JWKS at jwksURL,
+// then returns the RSA public key matching kid - or, if the token carries
+// no kid, the first key in the set.
+func fetchJWKSKey(jwksURL string, kid string) (*rsa.PublicKey, error) {
+  jwksCacheMu.Lock()
+  keySet, cached := jwksCache[jwksURL]
+  fresh := cached && time.Now().Before(jwksCacheExpiry[jwksURL])
+  jwksCacheMu.Unlock()
+
+  if !fresh {
+    resp, err := http.Get(jwksURL)
+    if err != nil {
+      return nil, fmt.Errorf("Unable to fetch JWKS: %s", err)
+    }
+    defer resp.Body.Close()
+    if err := json.NewDecoder(resp.Body).Decode(&keySet); err != nil {
+      return nil, fmt.Errorf("Unable to parse JWKS: %s", err)
+    }
+    jwksCacheMu.Lock()
+    jwksCache[jwksURL] = keySet
+    jwksCacheExpiry[jwksURL] = time.Now().Add(10 * time.Minute)
+    jwksCacheMu.Unlock()
+  }
+
+  for _, k := range keySet.Keys {
+    if kid == "" || k.Kid == kid {
+      return jwksKeyToRSAPublicKey(k.N, k.E)
+    }
+  }
+  return nil, fmt.Errorf("no matching JWKS key for kid %q", kid)
+}
+
+func jwksKeyToRSAPublicKey(nStr string, eStr string) (*rsa.PublicKey, error) {
+  nBytes, err := base64.RawURLEncoding.DecodeString(nStr)
+  if err != nil {
+    return nil, fmt.Errorf("Unable to decode JWKS modulus: %s", err)
+  }
+  eBytes, err := base64.RawURLEncoding.DecodeString(eStr)
+  if err != nil {
+    return nil, fmt.Errorf("Unable to decode JWKS exponent: %s", err)
+  }
+  e := 0
+  for _, b := range eBytes {
+    e = e<<8 | int(b)
+  }
+  return &rsa.PublicKey{N: new(big.Int).SetBytes(nBytes), E: e}, nil
+}
@@ -0,0 +1,148 @@
+// deputize - Update an LDAP group with info from the PagerDuty API
+// daemon.go: Long-running `deputize serve` mode
+//
+// Copyright 2017 Threat Stack, Inc. All rights reserved.
+// Author: Patrick T. Cable II <pat.cable@threatstack.com>
+
+package oncall
+
+import (
+  "context"
+  "github.com/prometheus/client_golang/prometheus/promhttp"
+  "log"
+  "net/http"
+  "os"
+  "os/signal"
+  "sync/atomic"
+  "syscall"
+  "time"
+)
+
+// ServeConfig controls the daemon started by `deputize serve`.
+type ServeConfig struct {
+  Interval time.Duration
+  MetricsAddr string
+  // Force, if set, ignores any saved sync state on the daemon's first run
+  // only; every later tick uses the state store normally.
+  Force bool
+}
+
+// DefaultServeConfig matches deputize's historical one-shot cadence: sync
+// on the same 12h window UpdateOnCallRotation has always queried, with a
+// bit of overlap so a slow run doesn't leave a gap before the next tick.
+func DefaultServeConfig() ServeConfig {
+  return ServeConfig{
+    Interval: 11*time.Hour + 30*time.Minute,
+    MetricsAddr: ":9090",
+  }
+}
+
+// Serve runs UpdateOnCallRotation on a fixed interval until SIGTERM/SIGINT,
+// exposing Prometheus metrics on cfg.MetricsAddr along with /healthz and
+// /readyz. This makes deputize deployable as a Kubernetes Deployment
+// instead of a cronjob. If config.AdminAPIAddr is set, it also starts the
+// JWT-protected admin API so ChatOps bots and incident tooling can query
+// or force a sync without shelling into the host.
+func Serve(cfg ServeConfig) error {
+  // ready is written by runOnce() on the daemon's ticker goroutine and
+  // read from /readyz on each request's own goroutine, so it needs to be
+  // accessed atomically rather than as a plain bool.
+  var ready int32
+
+  mux := http.NewServeMux()
+  mux.Handle("/metrics", promhttp.Handler())
+  mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+    w.WriteHeader(http.StatusOK)
+  })
+  mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+    if atomic.LoadInt32(&ready) == 0 {
+      http.Error(w, "no successful sync yet", http.StatusServiceUnavailable)
+      return
+    }
+    w.WriteHeader(http.StatusOK)
+  })
+  server := &http.Server{Addr: cfg.MetricsAddr, Handler: mux}
+
+  go func() {
+    if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+      log.Printf("Warning: metrics server stopped: %s\n", err)
+    }
+  }()
+
+  adminServer, err := startAdminAPI()
+  if err != nil {
+    return err
+  }
+
+  sigCh := make(chan os.Signal, 1)
+  signal.Notify(sigCh, syscall.SIGTERM, syscall.SIGINT)
+
+  firstRun := true
+  runOnce := func() {
+    force := firstRun && cfg.Force
+    firstRun = false
+    if err := UpdateOnCallRotation(force); err != nil {
+      log.Printf("Warning: sync failed: %s\n", err)
+      return
+    }
+    atomic.StoreInt32(&ready, 1)
+  }
+  runOnce()
+
+  ticker := time.NewTicker(cfg.Interval)
+  defer ticker.Stop()
+
+  for {
+    select {
+    case <-ticker.C:
+      runOnce()
+    case <-sigCh:
+      log.Printf("Received shutdown signal, draining\n")
+      ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+      defer cancel()
+      if adminServer != nil {
+        adminServer.Shutdown(ctx)
+      }
+      return server.Shutdown(ctx)
+    }
+  }
+}
+
+// startAdminAPI reads config.json to see whether the admin API is
+// configured, and if so starts it in the background. It returns a nil
+// server (and no error) when config.AdminAPIAddr is unset.
+func startAdminAPI() (*http.Server, error) {
+  config, err := loadConfig()
+  if err != nil {
+    return nil, err
+  }
+  if config.AdminAPIAddr == "" {
+    return nil, nil
+  }
+
+  vaultClient, secret, err := newVaultClient(config)
+  if err != nil {
+    return nil, err
+  }
+  jwtSecret, _ := secret.Data["adminAPIJWTSecret"].(string)
+  stateStore, err := NewStateStore(config, vaultClient)
+  if err != nil {
+    return nil, err
+  }
+
+  adminMux, err := newAdminAPIMux(AdminAPIConfig{
+    JWTHS256Secret: jwtSecret,
+    JWTJWKSURL: config.AdminAPIJWTJWKSURL,
+  }, config, stateStore, func() error { return UpdateOnCallRotation(false) })
+  if err != nil {
+    return nil, err
+  }
+
+  server := &http.Server{Addr: config.AdminAPIAddr, Handler: adminMux}
+  go func() {
+    if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+      log.Printf("Warning: admin API server stopped: %s\n", err)
+    }
+  }()
+  return server, nil
+}
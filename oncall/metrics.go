@@ -0,0 +1,52 @@
+// deputize - Update an LDAP group with info from the PagerDuty API
+// metrics.go: Prometheus metrics for daemon mode
+//
+// Copyright 2017 Threat Stack, Inc. All rights reserved.
+// Author: Patrick T. Cable II <pat.cable@threatstack.com>
+
+package oncall
+
+import (
+  "github.com/prometheus/client_golang/prometheus"
+  "github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+  runsTotal = promauto.NewCounter(prometheus.CounterOpts{
+    Name: "deputize_runs_total",
+    Help: "Total number of on-call rotation sync attempts.",
+  })
+  runDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+    Name: "deputize_run_duration_seconds",
+    Help: "Time taken by a single on-call rotation sync.",
+  })
+  ldapMembersTotal = promauto.NewGauge(prometheus.GaugeOpts{
+    Name: "deputize_ldap_members_total",
+    Help: "Number of members resolved for the on-call LDAP group on the last successful sync.",
+  })
+  lastSuccessTimestamp = promauto.NewGauge(prometheus.GaugeOpts{
+    Name: "deputize_last_success_timestamp",
+    Help: "Unix timestamp of the last successful on-call rotation sync.",
+  })
+  errorsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+    Name: "deputize_errors_total",
+    Help: "Total number of on-call rotation sync errors, by stage.",
+  }, []string{"stage"})
+  divergenceDetectedTotal = promauto.NewCounter(prometheus.CounterOpts{
+    Name: "deputize_divergence_detected_total",
+    Help: "Total number of syncs where PagerDuty and LDAP disagreed on who is on call, regardless of whether the sync went on to succeed.",
+  })
+  ldapDriftDetectedTotal = promauto.NewCounter(prometheus.CounterOpts{
+    Name: "deputize_ldap_drift_detected_total",
+    Help: "Total number of syncs where LDAP group membership no longer matched what deputize saved after its last successful sync, indicating an out-of-band edit.",
+  })
+)
+
+// stageErr records a stage-tagged error metric and returns err unchanged,
+// so callers can keep using their existing `return fmt.Errorf(...)` style
+// while still giving daemon operators a deputize_errors_total{stage=...}
+// to alert on.
+func stageErr(stage string, err error) error {
+  errorsTotal.WithLabelValues(stage).Inc()
+  return err
+}
@@ -0,0 +1,291 @@
+// deputize - Update an LDAP group with info from the PagerDuty API
+// notifier.go: On-call change notification sinks
+//
+// Copyright 2017 Threat Stack, Inc. All rights reserved.
+// Author: Patrick T. Cable II <pat.cable@threatstack.com>
+
+package oncall
+
+import (
+  "bytes"
+  "context"
+  "encoding/json"
+  "fmt"
+  "github.com/nlopes/slack"
+  "log"
+  "net/http"
+  "net/smtp"
+  "strings"
+  "text/template"
+)
+
+// OnCallChangeEvent describes an LDAP on-call group update, and is handed to
+// every configured Notifier so it can format its own message body.
+type OnCallChangeEvent struct {
+  LDAPServer string
+  Group string
+  Previous []string
+  Current []string
+}
+
+// defaultNotifyTemplate follows the wording of the message deputize has
+// always sent to Slack, but takes the group name from the event and does
+// not wrap the uid lists in braces. It is used by any notifier that isn't
+// given its own Template.
+const defaultNotifyTemplate = "Updated `{{.Group}}` on {{.LDAPServer}}: from {{StringsJoin .Previous \", \"}} to {{StringsJoin .Current \", \"}}"
+
+// Notifier announces an OnCallChangeEvent to some downstream sink. A
+// Notifier failing to deliver a message must not prevent other configured
+// Notifiers from running, so Notify errors are logged by the caller rather
+// than treated as fatal.
+type Notifier interface {
+  Notify(ctx context.Context, event OnCallChangeEvent) error
+}
+
+// NotifierConfig configures a single notification sink. Type selects the
+// implementation; the remaining fields are interpreted per-type. Multiple
+// NotifierConfigs may be listed so a rotation change fans out to more than
+// one sink.
+type NotifierConfig struct {
+  Type string
+  Channel string
+  WebhookURL string
+  Template string
+  SMTPServer string
+  SMTPPort int
+  EmailFrom string
+  EmailTo []string
+}
+
+// NewNotifiers builds the list of Notifiers described by configs. Each
+// notifier's credentials (e.g. a Slack token, SMTP password) come out of
+// the same Vault secret deputize already reads for LDAP and PagerDuty,
+// keyed by notifier type.
+func NewNotifiers(configs []NotifierConfig, secret map[string]interface{}) ([]Notifier, error) {
+  var notifiers []Notifier
+  for _, cfg := range configs {
+    tmpl, err := parseNotifyTemplate(cfg.Template)
+    if err != nil {
+      return nil, fmt.Errorf("Unable to parse notifier template: %s", err)
+    }
+    switch cfg.Type {
+    case "slack":
+      authToken, ok := secret["slackAuthToken"].(string)
+      if !ok {
+        return nil, fmt.Errorf("Vault secret is missing slackAuthToken")
+      }
+      notifiers = append(notifiers, &SlackNotifier{channel: cfg.Channel, authToken: authToken, template: tmpl})
+    case "teams":
+      notifiers = append(notifiers, &TeamsNotifier{webhookURL: cfg.WebhookURL, template: tmpl})
+    case "mattermost":
+      notifiers = append(notifiers, &MattermostNotifier{webhookURL: cfg.WebhookURL, channel: cfg.Channel, template: tmpl})
+    case "webhook":
+      notifiers = append(notifiers, &WebhookNotifier{url: cfg.WebhookURL, template: tmpl})
+    case "email":
+      username, _ := secret["smtpUsername"].(string)
+      password, _ := secret["smtpPassword"].(string)
+      notifiers = append(notifiers, &EmailNotifier{
+        server: cfg.SMTPServer,
+        port: cfg.SMTPPort,
+        username: username,
+        password: password,
+        from: cfg.EmailFrom,
+        to: cfg.EmailTo,
+        template: tmpl,
+      })
+    default:
+      return nil, fmt.Errorf("Unknown notifier type: %s", cfg.Type)
+    }
+  }
+  return notifiers, nil
+}
+
+// notifyAll calls Notify on every notifier, logging (but not returning) any
+// individual failure so one broken sink can't stop the others - the same
+// "log and continue" behavior deputize has always had for Slack. It
+// returns whether every notifier succeeded, so callers can remember that
+// in sync state and retry a failed notification on a later run.
+func notifyAll(ctx context.Context, notifiers []Notifier, event OnCallChangeEvent) bool {
+  allSucceeded := true
+  for _, n := range notifiers {
+    if err := n.Notify(ctx, event); err != nil {
+      log.Printf("Warning: notifier failed: %s\n", err)
+      allSucceeded = false
+    }
+  }
+  return allSucceeded
+}
+
+func parseNotifyTemplate(text string) (*template.Template, error) {
+  if text == "" {
+    text = defaultNotifyTemplate
+  }
+  funcs := template.FuncMap{"StringsJoin": func(items []string, sep string) string {
+    return strings.Join(items, sep)
+  }}
+  return template.New("notify").Funcs(funcs).Parse(text)
+}
+
+func renderNotifyTemplate(tmpl *template.Template, event OnCallChangeEvent) (string, error) {
+  var buf bytes.Buffer
+  if err := tmpl.Execute(&buf, event); err != nil {
+    return "", err
+  }
+  return buf.String(), nil
+}
+
+// SlackNotifier posts the change to a Slack channel. This is the original
+// notification deputize sent, now behind the Notifier interface.
+type SlackNotifier struct {
+  channel string
+  authToken string
+  template *template.Template
+}
+
+// Notify - see Notifier
+func (s *SlackNotifier) Notify(ctx context.Context, event OnCallChangeEvent) error {
+  msg, err := renderNotifyTemplate(s.template, event)
+  if err != nil {
+    return fmt.Errorf("Unable to render Slack message: %s", err)
+  }
+  slackAPI := slack.New(s.authToken)
+  slackParams := slack.PostMessageParameters{}
+  slackParams.AsUser = true
+  _, _, err = slackAPI.PostMessage(s.channel, msg, slackParams)
+  if err != nil {
+    return fmt.Errorf("Got %s back from Slack API", err)
+  }
+  return nil
+}
+
+// TeamsNotifier posts the change to a Microsoft Teams incoming webhook as
+// a legacy "MessageCard" connector card; it does not send an Adaptive Card.
+type TeamsNotifier struct {
+  webhookURL string
+  template *template.Template
+}
+
+type teamsAdaptiveCard struct {
+  Type string `json:"@type"`
+  Context string `json:"@context"`
+  Summary string `json:"summary"`
+  Text string `json:"text"`
+}
+
+// Notify - see Notifier
+func (t *TeamsNotifier) Notify(ctx context.Context, event OnCallChangeEvent) error {
+  msg, err := renderNotifyTemplate(t.template, event)
+  if err != nil {
+    return fmt.Errorf("Unable to render Teams message: %s", err)
+  }
+  card := teamsAdaptiveCard{
+    Type: "MessageCard",
+    Context: "http://schema.org/extensions",
+    Summary: fmt.Sprintf("On-call updated on %s", event.LDAPServer),
+    Text: msg,
+  }
+  return postJSON(ctx, t.webhookURL, card, "Teams")
+}
+
+// MattermostNotifier posts the change to a Mattermost incoming webhook.
+type MattermostNotifier struct {
+  webhookURL string
+  channel string
+  template *template.Template
+}
+
+type mattermostPayload struct {
+  Channel string `json:"channel,omitempty"`
+  Text string `json:"text"`
+}
+
+// Notify - see Notifier
+func (m *MattermostNotifier) Notify(ctx context.Context, event OnCallChangeEvent) error {
+  msg, err := renderNotifyTemplate(m.template, event)
+  if err != nil {
+    return fmt.Errorf("Unable to render Mattermost message: %s", err)
+  }
+  return postJSON(ctx, m.webhookURL, mattermostPayload{Channel: m.channel, Text: msg}, "Mattermost")
+}
+
+// WebhookNotifier posts the change as a generic JSON payload to an
+// arbitrary URL, for sinks deputize has no dedicated client for.
+type WebhookNotifier struct {
+  url string
+  template *template.Template
+}
+
+type webhookPayload struct {
+  LDAPServer string `json:"ldap_server"`
+  Group string `json:"group"`
+  Previous []string `json:"previous"`
+  Current []string `json:"current"`
+  Message string `json:"message"`
+}
+
+// Notify - see Notifier
+func (w *WebhookNotifier) Notify(ctx context.Context, event OnCallChangeEvent) error {
+  msg, err := renderNotifyTemplate(w.template, event)
+  if err != nil {
+    return fmt.Errorf("Unable to render webhook message: %s", err)
+  }
+  payload := webhookPayload{
+    LDAPServer: event.LDAPServer,
+    Group: event.Group,
+    Previous: event.Previous,
+    Current: event.Current,
+    Message: msg,
+  }
+  return postJSON(ctx, w.url, payload, "webhook")
+}
+
+func postJSON(ctx context.Context, url string, payload interface{}, name string) error {
+  body, err := json.Marshal(payload)
+  if err != nil {
+    return fmt.Errorf("Unable to build %s payload: %s", name, err)
+  }
+  req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+  if err != nil {
+    return fmt.Errorf("Unable to build %s request: %s", name, err)
+  }
+  req.Header.Set("Content-Type", "application/json")
+  resp, err := http.DefaultClient.Do(req)
+  if err != nil {
+    return fmt.Errorf("Got %s back from %s", err, name)
+  }
+  defer resp.Body.Close()
+  if resp.StatusCode >= 300 {
+    return fmt.Errorf("Got HTTP %d back from %s", resp.StatusCode, name)
+  }
+  return nil
+}
+
+// EmailNotifier emails the change via SMTP.
+type EmailNotifier struct {
+  server string
+  port int
+  username string
+  password string
+  from string
+  to []string
+  template *template.Template
+}
+
+// Notify - see Notifier
+func (e *EmailNotifier) Notify(ctx context.Context, event OnCallChangeEvent) error {
+  body, err := renderNotifyTemplate(e.template, event)
+  if err != nil {
+    return fmt.Errorf("Unable to render email message: %s", err)
+  }
+  addr := fmt.Sprintf("%s:%d", e.server, e.port)
+  var auth smtp.Auth
+  if e.username != "" {
+    auth = smtp.PlainAuth("", e.username, e.password, e.server)
+  }
+  msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: On-call updated on %s\r\n\r\n%s",
+    e.from, strings.Join(e.to, ", "), event.LDAPServer, body)
+  if err := smtp.SendMail(addr, auth, e.from, e.to, []byte(msg)); err != nil {
+    return fmt.Errorf("Unable to send email: %s", err)
+  }
+  return nil
+}
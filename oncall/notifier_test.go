@@ -0,0 +1,75 @@
+// deputize - Update an LDAP group with info from the PagerDuty API
+// notifier_test.go: Tests for the Notifier sinks
+//
+// Copyright 2017 Threat Stack, Inc. All rights reserved.
+// Author: Patrick T. Cable II <pat.cable@threatstack.com>
+
+package oncall
+
+import (
+  "context"
+  "fmt"
+  "net/http"
+  "net/http/httptest"
+  "testing"
+)
+
+func TestPostJSONRejectsErrorStatus(t *testing.T) {
+  server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    w.WriteHeader(http.StatusInternalServerError)
+  }))
+  defer server.Close()
+
+  if err := postJSON(context.Background(), server.URL, map[string]string{"hello": "world"}, "webhook"); err == nil {
+    t.Fatal("expected an error for a non-2xx response, got nil")
+  }
+}
+
+func TestPostJSONAcceptsSuccessStatus(t *testing.T) {
+  server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    w.WriteHeader(http.StatusOK)
+  }))
+  defer server.Close()
+
+  if err := postJSON(context.Background(), server.URL, map[string]string{"hello": "world"}, "webhook"); err != nil {
+    t.Fatalf("unexpected error for a 2xx response: %s", err)
+  }
+}
+
+// fakeNotifier is a Notifier test double that always fails or succeeds as
+// configured, recording whether it was called.
+type fakeNotifier struct {
+  err error
+  called bool
+}
+
+func (f *fakeNotifier) Notify(ctx context.Context, event OnCallChangeEvent) error {
+  f.called = true
+  return f.err
+}
+
+// TestNotifyAllContinuesPastFailingNotifier checks that one notifier
+// failing doesn't stop the others from running, and that notifyAll
+// reports the overall failure so callers can retry later.
+func TestNotifyAllContinuesPastFailingNotifier(t *testing.T) {
+  failing := &fakeNotifier{err: fmt.Errorf("boom")}
+  succeeding := &fakeNotifier{}
+
+  ok := notifyAll(context.Background(), []Notifier{failing, succeeding}, OnCallChangeEvent{})
+
+  if !failing.called || !succeeding.called {
+    t.Errorf("expected both notifiers to be called, got failing=%v succeeding=%v", failing.called, succeeding.called)
+  }
+  if ok {
+    t.Error("expected notifyAll to report failure when a notifier errors")
+  }
+}
+
+func TestNotifyAllReportsSuccess(t *testing.T) {
+  a := &fakeNotifier{}
+  b := &fakeNotifier{}
+
+  if !notifyAll(context.Background(), []Notifier{a, b}, OnCallChangeEvent{}) {
+    t.Error("expected notifyAll to report success when every notifier succeeds")
+  }
+}
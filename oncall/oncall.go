@@ -7,115 +7,198 @@
 package oncall
 
 import (
+  "context"
   "crypto/tls"
   "crypto/x509"
   "encoding/json"
   "fmt"
-  "github.com/nlopes/slack"
-  "github.com/PagerDuty/go-pagerduty"
   vault "github.com/hashicorp/vault/api"
-  "gopkg.in/ldap.v2"
+  "gopkg.in/ldap.v3"
   "io/ioutil"
   "log"
   "os"
   "reflect"
   "strings"
+  "sync"
   "time"
 )
 
 // DeputizeConfig is our config struct
 type DeputizeConfig struct {
+  AdminAPIAddr string
+  AdminAPIJWTJWKSURL string
   BaseDN string
+  ClientCertFile string
+  ClientKeyFile string
+  HTTPProviderURL string
+  LDAPAuthMode string
   LDAPServer string
   LDAPPort int
   MailAttribute string
   MemberAttribute string
   ModUserDN string
+  Notifiers []NotifierConfig
   OnCallGroup string
   OnCallGroupDN string
+  OnCallProvider string
   OnCallSchedules []string
+  OpsGenieRegion string
   RootCAFile string
   SlackChan string
   SlackEnabled bool
+  StateBackend string
+  StateFile string
   TokenPath string
   VaultSecretPath string
   VaultServer string
 }
 
-// UpdateOnCallRotation - read in config and update the on call config.
-func UpdateOnCallRotation() error {
-  // Configure the things
+// UpdateOnCallRotation - read in config and update the on call config. If
+// force is true, any previously saved sync state is ignored rather than
+// used for drift detection and notification de-duplication.
+// Wraps updateOnCallRotation with the run-level metrics daemon mode relies
+// on (deputize_runs_total, deputize_run_duration_seconds,
+// deputize_last_success_timestamp).
+func UpdateOnCallRotation(force bool) error {
+  runsTotal.Inc()
+  start := time.Now()
+  err := updateOnCallRotation(force)
+  runDuration.Observe(time.Since(start).Seconds())
+  if err != nil {
+    return err
+  }
+  lastSuccessTimestamp.Set(float64(time.Now().Unix()))
+  return nil
+}
+
+// loadConfig reads and parses config.json. It's shared by
+// updateOnCallRotation and by Serve, which needs the config up front to
+// decide whether to start the admin API.
+func loadConfig() (DeputizeConfig, error) {
   var config DeputizeConfig
   var cfile = "config.json"
   jsonConfig, _ := os.Open(cfile)
   decoder := json.NewDecoder(jsonConfig)
-  config = DeputizeConfig{}
   err := decoder.Decode(&config)
   if err != nil {
-    return fmt.Errorf("Unable to parse config.json: %s", err)
+    return config, stageErr("config", fmt.Errorf("Unable to parse config.json: %s", err))
   }
+  return config, nil
+}
 
-  var currentTime = time.Now()
-
-  // We use vault for storing the LDAP user password, PD token, Slack token
+// newVaultClient builds an authenticated Vault client from config -
+// either a token from TokenPath/VAULT_TOKEN, or (if a client cert is
+// configured) the TLS auth method - and reads deputize's stored secrets.
+// Shared by updateOnCallRotation and Serve's admin API setup.
+func newVaultClient(config DeputizeConfig) (*vault.Client, *vault.Secret, error) {
   vaultConfig := vault.DefaultConfig()
   vaultConfig.Address = config.VaultServer
+  if config.ClientCertFile != "" && config.ClientKeyFile != "" {
+    tlsErr := vaultConfig.ConfigureTLS(&vault.TLSConfig{
+      ClientCert: config.ClientCertFile,
+      ClientKey: config.ClientKeyFile,
+    })
+    if tlsErr != nil {
+      return nil, nil, stageErr("vault", fmt.Errorf("Unable to configure Vault client cert: %s", tlsErr))
+    }
+  }
   vaultClient, err := vault.NewClient(vaultConfig)
   if err != nil {
-    return fmt.Errorf("Error initializing Vault client: %s\n", err)
+    return nil, nil, stageErr("vault", fmt.Errorf("Error initializing Vault client: %s\n", err))
   }
-  if config.TokenPath == "" {
-    if os.Getenv("VAULT_TOKEN") == "" {
-      return fmt.Errorf("TokenPath isn't set & no VAULT_TOKEN env present")
-    }
-  } else {
+  if config.TokenPath != "" {
     vaultToken, err := ioutil.ReadFile(config.TokenPath)
     if err != nil {
-      return fmt.Errorf("Unable to read host token from %s", config.TokenPath)
+      return nil, nil, stageErr("vault", fmt.Errorf("Unable to read host token from %s", config.TokenPath))
     }
     vaultClient.SetToken(strings.TrimSpace(string(vaultToken)))
+  } else if os.Getenv("VAULT_TOKEN") == "" {
+    if config.ClientCertFile == "" {
+      return nil, nil, stageErr("vault", fmt.Errorf("TokenPath isn't set & no VAULT_TOKEN env present"))
+    }
+    // No token or env var configured, so fall back to the TLS auth method
+    // and let the client cert we just configured speak for us.
+    certAuth, err := vaultClient.Logical().Write("auth/cert/login", nil)
+    if err != nil {
+      return nil, nil, stageErr("vault", fmt.Errorf("Unable to authenticate to Vault with client cert: %s", err))
+    }
+    vaultClient.SetToken(certAuth.Auth.ClientToken)
   }
   secret, err := vaultClient.Logical().Read("secret/deputize")
   if err != nil {
-    return fmt.Errorf("Unable to read secrets from vault: ", config.VaultSecretPath)
+    return nil, nil, stageErr("vault", fmt.Errorf("Unable to read secrets from vault: %s", config.VaultSecretPath))
+  }
+  return vaultClient, secret, nil
+}
+
+// syncMu serializes runs of updateOnCallRotation - the daemon's ticker and
+// a manually triggered POST /v1/rotate could otherwise race and write
+// conflicting sync state.
+var syncMu sync.Mutex
+
+func updateOnCallRotation(force bool) error {
+  syncMu.Lock()
+  defer syncMu.Unlock()
+
+  config, err := loadConfig()
+  if err != nil {
+    return err
+  }
+
+  vaultClient, secret, err := newVaultClient(config)
+  if err != nil {
+    return err
+  }
+
+  // Begin talking to whichever on-call source deputize is configured for
+  authToken, err := providerAuthToken(config, secret.Data)
+  if err != nil {
+    return stageErr("provider", err)
+  }
+  provider, err := NewProvider(config, authToken)
+  if err != nil {
+    return stageErr("provider", err)
+  }
+
+  notifierConfigs := config.Notifiers
+  if config.SlackEnabled {
+    // SlackChan/SlackEnabled predate the Notifiers list; keep them working
+    // as a shorthand for a single Slack notifier.
+    notifierConfigs = append(notifierConfigs, NotifierConfig{Type: "slack", Channel: config.SlackChan})
+  }
+  notifiers, err := NewNotifiers(notifierConfigs, secret.Data)
+  if err != nil {
+    return stageErr("notifier", err)
+  }
+  stateStore, err := NewStateStore(config, vaultClient)
+  if err != nil {
+    return stageErr("state", err)
+  }
+  var prevState *SyncState
+  if !force {
+    prevState, err = stateStore.Load()
+    if err != nil {
+      log.Printf("Warning: unable to load previous sync state: %s\n", err)
+    } else if prevState != nil && prevState.ConfigHash != configHash(config) {
+      log.Printf("Stored sync state is from a different config, ignoring it\n")
+      prevState = nil
+    }
   }
 
-  // Begin talking to PagerDuty
-  client := pagerduty.NewClient(secret.Data["pdAuthToken"].(string))
   log.Printf("Deputize starting. Oncall groups: %s", strings.Join(config.OnCallSchedules[:],", "))
-  var newOnCallEmails []string
   var newOnCallUids []string
+  var scheduleUids map[string][]string
 
-  // Cycle through the schedules and once we hit one we care about, get the
-  // email address of the person on call for the date period between runtime
-  // and runtime+12 hours
-  var lsSchedulesOpts pagerduty.ListSchedulesOptions
-  if allSchedulesPD, err := client.ListSchedules(lsSchedulesOpts); err != nil {
-    return fmt.Errorf("PagerDuty Client says: %s", err)
-  } else {
-    for _, p := range allSchedulesPD.Schedules {
-      if contains(config.OnCallSchedules, p.Name) {
-        // We've hit one of the schedules we care about, so let's get the list
-        // of on-call users between today and +12 hours.
-        var onCallOpts pagerduty.ListOnCallUsersOptions
-        onCallOpts.Since = currentTime.Format("2006-01-02T15:04:05Z07:00")
-        hours, _ := time.ParseDuration("12h")
-        onCallOpts.Until = currentTime.Add(hours).Format("2006-01-02T15:04:05Z07:00")
-        log.Printf("Getting oncall for schedule \"%s\" (%s) between %s and %s",
-          p.Name, p.APIObject.ID, onCallOpts.Since, onCallOpts.Until)
-        if oncall, err := client.ListOnCallUsers(p.APIObject.ID, onCallOpts); err != nil {
-            return fmt.Errorf("Unable to ListOnCallUsers: %s", err)
-        } else {
-          for _, person := range oncall {
-            newOnCallEmails = append(newOnCallEmails, person.Email)
-          }
-        }
-      }
-    }
+  // Get the person on call for the date period between runtime and
+  // runtime+12 hours, for each schedule we care about.
+  hours, _ := time.ParseDuration("12h")
+  people, err := provider.GetCurrentOnCall(context.Background(), config.OnCallSchedules, hours)
+  if err != nil {
+    return stageErr("provider", err)
   }
 
   // Now to figure out what LDAP user the email correlates to
-  l, err := ldap.Dial("tcp", fmt.Sprintf("%s:%d", config.LDAPServer, config.LDAPPort))
+  l, err := ldap.DialURL(fmt.Sprintf("ldap://%s:%d", config.LDAPServer, config.LDAPPort))
   if err != nil {
     log.Fatal(err)
   }
@@ -131,17 +214,25 @@ func UpdateOnCallRotation() error {
     rootCerts := x509.NewCertPool()
     rootCAFile, err := ioutil.ReadFile(config.RootCAFile)
     if err != nil {
-      return fmt.Errorf("Unable to read RootCAFile: %s", err)
+      return stageErr("ldap", fmt.Errorf("Unable to read RootCAFile: %s", err))
     }
     if !rootCerts.AppendCertsFromPEM(rootCAFile) {
-      return fmt.Errorf("Unable to append certs")
+      return stageErr("ldap", fmt.Errorf("Unable to append certs"))
     }
     tlsConfig.RootCAs = rootCerts
   }
 
+  if config.ClientCertFile != "" && config.ClientKeyFile != "" {
+    clientCert, err := tls.LoadX509KeyPair(config.ClientCertFile, config.ClientKeyFile)
+    if err != nil {
+      return stageErr("ldap", fmt.Errorf("Unable to load client cert/key: %s", err))
+    }
+    tlsConfig.Certificates = []tls.Certificate{clientCert}
+  }
+
   err = l.StartTLS(tlsConfig)
   if err != nil {
-    return fmt.Errorf("Unable to start TLS connection: %s", err)
+    return stageErr("ldap", fmt.Errorf("Unable to start TLS connection: %s", err))
   }
 
   // get current members of lg-oncall group (needed for removal later)
@@ -152,51 +243,182 @@ func UpdateOnCallRotation() error {
   // both slices are sorted the same way so DeepEqual works
   currentOnCallUids = removeDuplicates(currentOnCallUids)
 
-  for _, email := range newOnCallEmails {
-    newOnCall := search(l, config.BaseDN, fmt.Sprintf("(%s=%s)", config.MailAttribute, email), []string{"uid"})
-    newOnCallUids = append(newOnCallUids, newOnCall.Entries[0].GetAttributeValue("uid"))
+  if prevState != nil {
+    var savedUids []string
+    for _, uids := range prevState.ScheduleUids {
+      savedUids = append(savedUids, uids...)
+    }
+    savedUids = removeDuplicates(savedUids)
+    if !reflect.DeepEqual(savedUids, currentOnCallUids) {
+      log.Printf("Warning: LDAP membership drifted out-of-band since last successful sync (expected %s, found %s)\n",
+        strings.Join(savedUids,", "), strings.Join(currentOnCallUids,", "))
+      ldapDriftDetectedTotal.Inc()
+    }
   }
-  newOnCallUids = removeDuplicates(newOnCallUids)
+
+  newOnCallUids, scheduleUids = resolveScheduleUids(people, func(email string) string {
+    newOnCall := search(l, config.BaseDN, fmt.Sprintf("(%s=%s)", config.MailAttribute, email), []string{"uid"})
+    return newOnCall.Entries[0].GetAttributeValue("uid")
+  })
 
   log.Printf("New on call (PagerDuty): %s", strings.Join(newOnCallUids[:],", "))
 
+  notifySucceeded := true
   if reflect.DeepEqual(currentOnCallUids,newOnCallUids) {
     log.Printf("LDAP and PagerDuty match, doing nothing.\n")
+    if prevState != nil && !prevState.NotifySucceeded {
+      // LDAP already matches, but the last run's notification failed
+      // before it could tell anyone - retry it instead of staying silent.
+      log.Printf("Retrying notification that failed on the previous run\n")
+      notifySucceeded = notifyAll(context.Background(), notifiers, OnCallChangeEvent{
+        LDAPServer: config.LDAPServer,
+        Group: config.OnCallGroup,
+        Previous: currentOnCallUids,
+        Current: newOnCallUids,
+      })
+    }
   } else {
     log.Printf("Replacing LDAP with PagerDuty information.\n")
+    // PagerDuty and LDAP disagree - count it here, before we know whether
+    // the sync below actually succeeds, so daemon operators can alert on
+    // divergence even when the reconcile that follows papers over it.
+    divergenceDetectedTotal.Inc()
 
-    if err := l.Bind(config.ModUserDN, secret.Data["modUserPW"].(string)); err != nil {
-      return fmt.Errorf("Unable to bind to LDAP as %s", config.ModUserDN)
+    if err := bindLDAP(l, config, secret.Data); err != nil {
+      return stageErr("ldap", err)
     }
 
-    if len(currentOnCallUids) > 0 {
-      log.Printf("LDAP: Deleting old UIDs")
-      delUsers := ldap.NewModifyRequest(config.OnCallGroupDN)
-      delUsers.Delete(config.MemberAttribute, currentOnCallUids)
-      if err = l.Modify(delUsers); err != nil {
-        return fmt.Errorf("Unable to delete existing users from LDAP")
+    additions, removals := diffUids(currentOnCallUids, newOnCallUids)
+    log.Printf("LDAP: adding %s", strings.Join(additions,", "))
+    log.Printf("LDAP: removing %s", strings.Join(removals,", "))
+
+    replaceUsers := ldap.NewModifyRequest(config.OnCallGroupDN)
+    replaceUsers.Replace(config.MemberAttribute, newOnCallUids)
+    if err = l.Modify(replaceUsers); err != nil {
+      // Some LDAP servers reject Replace in ways a plain Delete+Add would
+      // tolerate (e.g. schema quirks on multi-valued attributes). Fall
+      // back to the old two-step flow, but roll back to the known-good
+      // members if the Add half fails, so a network blip never leaves the
+      // on-call group empty.
+      log.Printf("Warning: LDAP Modify-Replace rejected (%s), falling back to delete+add", err)
+      if err = deleteAddWithRollback(l, config, currentOnCallUids, newOnCallUids); err != nil {
+        return stageErr("ldap", err)
       }
     }
-    log.Printf("LDAP: Adding new UIDs")
-    addUsers := ldap.NewModifyRequest(config.OnCallGroupDN)
-    addUsers.Add(config.MemberAttribute, newOnCallUids)
-    if err = l.Modify(addUsers); err != nil {
-      return fmt.Errorf("Unable to add new users to LDAP")
-    }
-
-    if config.SlackEnabled == true {
-      slackAPI := slack.New(secret.Data["slackAuthToken"].(string))
-      slackParams := slack.PostMessageParameters{}
-      slackParams.AsUser = true
-      slackMsg := fmt.Sprintf("Updated `lg-oncall` on %s: from {%s} to {%s}",
-        config.LDAPServer,
-        strings.Join(currentOnCallUids[:],", "),
-        strings.Join(newOnCallUids[:],", "))
-      _,_,err := slackAPI.PostMessage(config.SlackChan, slackMsg, slackParams)
-      if err != nil {
-        log.Printf("Warning: Got %s back from Slack API\n", err)
-      }
+
+    notifySucceeded = notifyAll(context.Background(), notifiers, OnCallChangeEvent{
+      LDAPServer: config.LDAPServer,
+      Group: config.OnCallGroup,
+      Previous: currentOnCallUids,
+      Current: newOnCallUids,
+    })
+  }
+
+  if err := stateStore.Save(&SyncState{
+    Timestamp: time.Now(),
+    ScheduleUids: scheduleUids,
+    ConfigHash: configHash(config),
+    NotifySucceeded: notifySucceeded,
+  }); err != nil {
+    log.Printf("Warning: unable to save sync state: %s\n", err)
+  }
+
+  ldapMembersTotal.Set(float64(len(newOnCallUids)))
+  return nil
+}
+
+// bindLDAP authenticates the LDAP connection using config.LDAPAuthMode.
+// "simple" (the default) binds with ModUserDN and the modUserPW Vault
+// secret, as deputize always has. "external" and "mtls" instead issue a
+// SASL EXTERNAL bind, relying on the client certificate already presented
+// during StartTLS to establish identity; "mtls" additionally requires
+// deputize to have loaded that certificate itself via ClientCertFile/
+// ClientKeyFile.
+func bindLDAP(l *ldap.Conn, config DeputizeConfig, secret map[string]interface{}) error {
+  switch config.LDAPAuthMode {
+  case "", "simple":
+    modUserPW, ok := secret["modUserPW"].(string)
+    if !ok {
+      return fmt.Errorf("Vault secret is missing modUserPW")
+    }
+    if err := l.Bind(config.ModUserDN, modUserPW); err != nil {
+      return fmt.Errorf("Unable to bind to LDAP as %s", config.ModUserDN)
+    }
+  case "external", "mtls":
+    if config.LDAPAuthMode == "mtls" && (config.ClientCertFile == "" || config.ClientKeyFile == "") {
+      return fmt.Errorf("LDAPAuthMode \"mtls\" requires ClientCertFile and ClientKeyFile to be set")
+    }
+    if err := l.ExternalBind(); err != nil {
+      return fmt.Errorf("Unable to SASL EXTERNAL bind to LDAP: %s", err)
+    }
+  default:
+    return fmt.Errorf("Unknown LDAPAuthMode: %s", config.LDAPAuthMode)
+  }
+  return nil
+}
+
+// resolveScheduleUids turns the people an OnCallProvider resolved as on
+// call into LDAP uids and a per-schedule breakdown, using lookupUid to
+// turn a Person's email into a uid. It's split out of updateOnCallRotation
+// so the provider-to-uid mapping can be driven by a fake lookupUid in
+// tests, without needing a live LDAP connection.
+func resolveScheduleUids(people []Person, lookupUid func(email string) string) (uids []string, scheduleUids map[string][]string) {
+  scheduleUids = make(map[string][]string)
+  for _, person := range people {
+    uid := lookupUid(person.Email)
+    uids = append(uids, uid)
+    scheduleUids[person.Schedule] = append(scheduleUids[person.Schedule], uid)
+  }
+  uids = removeDuplicates(uids)
+  return
+}
+
+// diffUids splits the change from current to new membership into the uids
+// being added and the uids being removed, so callers can log each
+// separately for auditability.
+func diffUids(current []string, new []string) (additions []string, removals []string) {
+  currentSet := make(map[string]bool, len(current))
+  for _, uid := range current {
+    currentSet[uid] = true
+  }
+  newSet := make(map[string]bool, len(new))
+  for _, uid := range new {
+    newSet[uid] = true
+  }
+  for _, uid := range new {
+    if !currentSet[uid] {
+      additions = append(additions, uid)
+    }
+  }
+  for _, uid := range current {
+    if !newSet[uid] {
+      removals = append(removals, uid)
+    }
+  }
+  return
+}
+
+// deleteAddWithRollback is the fallback used when a Modify-Replace of the
+// on-call group is rejected. It performs the old Delete-then-Add sequence,
+// but if the Add fails after the Delete has already gone through, it
+// re-adds the previous members rather than leaving the group empty.
+func deleteAddWithRollback(l *ldap.Conn, config DeputizeConfig, currentOnCallUids []string, newOnCallUids []string) error {
+  if len(currentOnCallUids) > 0 {
+    delUsers := ldap.NewModifyRequest(config.OnCallGroupDN)
+    delUsers.Delete(config.MemberAttribute, currentOnCallUids)
+    if err := l.Modify(delUsers); err != nil {
+      return fmt.Errorf("Unable to delete existing users from LDAP: %s", err)
+    }
+  }
+  addUsers := ldap.NewModifyRequest(config.OnCallGroupDN)
+  addUsers.Add(config.MemberAttribute, newOnCallUids)
+  if err := l.Modify(addUsers); err != nil {
+    rollback := ldap.NewModifyRequest(config.OnCallGroupDN)
+    rollback.Add(config.MemberAttribute, currentOnCallUids)
+    if rollbackErr := l.Modify(rollback); rollbackErr != nil {
+      return fmt.Errorf("Unable to add new users to LDAP (%s), and rollback to previous members also failed (%s)", err, rollbackErr)
     }
+    return fmt.Errorf("Unable to add new users to LDAP: %s (rolled back to previous members)", err)
   }
   return nil
 }
\ No newline at end of file
@@ -0,0 +1,75 @@
+// deputize - Update an LDAP group with info from the PagerDuty API
+// oncall_test.go: Tests for the on-call resolution path
+//
+// Copyright 2017 Threat Stack, Inc. All rights reserved.
+// Author: Patrick T. Cable II <pat.cable@threatstack.com>
+
+package oncall
+
+import (
+  "context"
+  "reflect"
+  "testing"
+  "time"
+)
+
+// fakeProvider is the OnCallProvider test double the interface was built
+// to enable: a fixed list of Person, no live API calls.
+type fakeProvider struct {
+  people []Person
+  err error
+}
+
+func (f *fakeProvider) GetCurrentOnCall(ctx context.Context, schedules []string, window time.Duration) ([]Person, error) {
+  return f.people, f.err
+}
+
+// TestResolveScheduleUids drives the provider -> LDAP-uid mapping
+// updateOnCallRotation relies on through a fakeProvider, standing in for
+// the uid lookup a real run would do against LDAP.
+func TestResolveScheduleUids(t *testing.T) {
+  provider := &fakeProvider{people: []Person{
+    {Name: "Alice", Email: "alice@example.com", Schedule: "primary"},
+    {Name: "Bob", Email: "bob@example.com", Schedule: "secondary"},
+    {Name: "Alice", Email: "alice@example.com", Schedule: "secondary"},
+  }}
+
+  people, err := provider.GetCurrentOnCall(context.Background(), []string{"primary", "secondary"}, 12*time.Hour)
+  if err != nil {
+    t.Fatalf("GetCurrentOnCall returned an error: %s", err)
+  }
+
+  emailToUid := map[string]string{
+    "alice@example.com": "auid",
+    "bob@example.com": "buid",
+  }
+  uids, scheduleUids := resolveScheduleUids(people, func(email string) string {
+    return emailToUid[email]
+  })
+
+  wantUids := []string{"auid", "buid"}
+  if !reflect.DeepEqual(uids, wantUids) {
+    t.Errorf("uids = %v, want %v", uids, wantUids)
+  }
+
+  wantScheduleUids := map[string][]string{
+    "primary": {"auid"},
+    "secondary": {"buid", "auid"},
+  }
+  if !reflect.DeepEqual(scheduleUids, wantScheduleUids) {
+    t.Errorf("scheduleUids = %v, want %v", scheduleUids, wantScheduleUids)
+  }
+}
+
+// TestDiffUids checks the addition/removal split bindLDAP's caller logs
+// before reconciling LDAP.
+func TestDiffUids(t *testing.T) {
+  additions, removals := diffUids([]string{"auid", "buid"}, []string{"buid", "cuid"})
+
+  if !reflect.DeepEqual(additions, []string{"cuid"}) {
+    t.Errorf("additions = %v, want [cuid]", additions)
+  }
+  if !reflect.DeepEqual(removals, []string{"auid"}) {
+    t.Errorf("removals = %v, want [auid]", removals)
+  }
+}
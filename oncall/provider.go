@@ -0,0 +1,233 @@
+// deputize - Update an LDAP group with info from the PagerDuty API
+// provider.go: On-call source providers
+//
+// Copyright 2017 Threat Stack, Inc. All rights reserved.
+// Author: Patrick T. Cable II <pat.cable@threatstack.com>
+
+package oncall
+
+import (
+  "bytes"
+  "context"
+  "encoding/json"
+  "fmt"
+  "github.com/PagerDuty/go-pagerduty"
+  "log"
+  "net/http"
+  "net/url"
+  "time"
+)
+
+// Person represents someone resolved as currently on call by an
+// OnCallProvider. LDAP lookups turn the Email into a uid downstream.
+type Person struct {
+  Name string
+  Email string
+  Schedule string
+}
+
+// OnCallProvider resolves who is on call for a set of named schedules within
+// a rolling time window starting now. Implementations wrap whatever
+// scheduling system deputize is configured to read from, which keeps
+// UpdateOnCallRotation testable against a fake and lets non-PagerDuty shops
+// reuse the LDAP-sync machinery.
+type OnCallProvider interface {
+  GetCurrentOnCall(ctx context.Context, schedules []string, window time.Duration) ([]Person, error)
+}
+
+// NewProvider builds the OnCallProvider selected by config.OnCallProvider.
+// An empty value defaults to "pagerduty" so existing configs keep working.
+func NewProvider(config DeputizeConfig, authToken string) (OnCallProvider, error) {
+  switch config.OnCallProvider {
+  case "", "pagerduty":
+    return &PagerDutyProvider{client: pagerduty.NewClient(authToken)}, nil
+  case "opsgenie":
+    return &OpsGenieProvider{apiKey: authToken, region: config.OpsGenieRegion}, nil
+  case "http":
+    return &HTTPProvider{endpoint: config.HTTPProviderURL, authToken: authToken}, nil
+  default:
+    return nil, fmt.Errorf("Unknown OnCallProvider: %s", config.OnCallProvider)
+  }
+}
+
+// PagerDutyProvider implements OnCallProvider against the PagerDuty API. This
+// is the original behavior of UpdateOnCallRotation, moved here unchanged.
+type PagerDutyProvider struct {
+  client *pagerduty.Client
+}
+
+// GetCurrentOnCall - see OnCallProvider
+func (p *PagerDutyProvider) GetCurrentOnCall(ctx context.Context, schedules []string, window time.Duration) ([]Person, error) {
+  var people []Person
+  var lsSchedulesOpts pagerduty.ListSchedulesOptions
+  allSchedulesPD, err := p.client.ListSchedules(lsSchedulesOpts)
+  if err != nil {
+    return nil, fmt.Errorf("PagerDuty Client says: %s", err)
+  }
+
+  currentTime := time.Now()
+  for _, s := range allSchedulesPD.Schedules {
+    if !contains(schedules, s.Name) {
+      continue
+    }
+    // We've hit one of the schedules we care about, so let's get the list
+    // of on-call users between now and now+window.
+    var onCallOpts pagerduty.ListOnCallUsersOptions
+    onCallOpts.Since = currentTime.Format("2006-01-02T15:04:05Z07:00")
+    onCallOpts.Until = currentTime.Add(window).Format("2006-01-02T15:04:05Z07:00")
+    log.Printf("Getting oncall for schedule \"%s\" (%s) between %s and %s",
+      s.Name, s.APIObject.ID, onCallOpts.Since, onCallOpts.Until)
+    oncall, err := p.client.ListOnCallUsers(s.APIObject.ID, onCallOpts)
+    if err != nil {
+      return nil, fmt.Errorf("Unable to ListOnCallUsers: %s", err)
+    }
+    for _, person := range oncall {
+      people = append(people, Person{Name: person.Name, Email: person.Email, Schedule: s.Name})
+    }
+  }
+  return people, nil
+}
+
+// OpsGenieProvider implements OnCallProvider against the OpsGenie REST API.
+// region selects between OpsGenie's US ("us", the default) and EU ("eu")
+// hosted API, which use different base URLs.
+type OpsGenieProvider struct {
+  apiKey string
+  region string
+  // baseURLOverride replaces the region-derived base URL when set, for
+  // pointing GetCurrentOnCall at a test server instead of the real API.
+  baseURLOverride string
+}
+
+func (o *OpsGenieProvider) baseURL() string {
+  if o.baseURLOverride != "" {
+    return o.baseURLOverride
+  }
+  if o.region == "eu" {
+    return "https://api.eu.opsgenie.com"
+  }
+  return "https://api.opsgenie.com"
+}
+
+type opsGenieOnCallResponse struct {
+  Data struct {
+    OnCallRecipients []string `json:"onCallRecipients"`
+  } `json:"data"`
+}
+
+// GetCurrentOnCall - see OnCallProvider. OpsGenie schedules resolve directly
+// to on-call recipient email addresses, unlike PagerDuty's per-user objects.
+// window is not used: it returns whoever is on call at the time of the
+// request.
+func (o *OpsGenieProvider) GetCurrentOnCall(ctx context.Context, schedules []string, window time.Duration) ([]Person, error) {
+  var people []Person
+  for _, name := range schedules {
+    recipients, err := o.getScheduleOnCall(ctx, name)
+    if err != nil {
+      return nil, err
+    }
+    for _, recipient := range recipients {
+      people = append(people, Person{Email: recipient, Schedule: name})
+    }
+  }
+  return people, nil
+}
+
+// getScheduleOnCall fetches the on-call recipients for a single schedule. It
+// is split out from GetCurrentOnCall so resp.Body is closed at the end of
+// each schedule's request instead of piling up for the whole loop.
+func (o *OpsGenieProvider) getScheduleOnCall(ctx context.Context, name string) ([]string, error) {
+  reqURL := fmt.Sprintf("%s/v2/schedules/%s/on-calls?scheduleIdentifierType=name", o.baseURL(), url.PathEscape(name))
+  req, err := http.NewRequestWithContext(ctx, "GET", reqURL, nil)
+  if err != nil {
+    return nil, fmt.Errorf("Unable to build OpsGenie request: %s", err)
+  }
+  req.Header.Set("Authorization", fmt.Sprintf("GenieKey %s", o.apiKey))
+
+  resp, err := http.DefaultClient.Do(req)
+  if err != nil {
+    return nil, fmt.Errorf("OpsGenie Client says: %s", err)
+  }
+  defer resp.Body.Close()
+
+  if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+    return nil, fmt.Errorf("OpsGenie returned HTTP %d for schedule %q", resp.StatusCode, name)
+  }
+
+  var oncall opsGenieOnCallResponse
+  if err := json.NewDecoder(resp.Body).Decode(&oncall); err != nil {
+    return nil, fmt.Errorf("Unable to parse OpsGenie response: %s", err)
+  }
+  return oncall.Data.OnCallRecipients, nil
+}
+
+// HTTPProvider implements OnCallProvider against a generic HTTP/JSON
+// endpoint, for on-call sources deputize has no dedicated client for. It
+// POSTs the requested schedules and window, and expects back a JSON array
+// of Person objects.
+type HTTPProvider struct {
+  endpoint string
+  authToken string
+}
+
+// GetCurrentOnCall - see OnCallProvider
+func (h *HTTPProvider) GetCurrentOnCall(ctx context.Context, schedules []string, window time.Duration) ([]Person, error) {
+  reqBody, err := json.Marshal(struct {
+    Schedules []string `json:"schedules"`
+    WindowSeconds float64 `json:"window_seconds"`
+  }{schedules, window.Seconds()})
+  if err != nil {
+    return nil, fmt.Errorf("Unable to build HTTP provider request: %s", err)
+  }
+
+  req, err := http.NewRequestWithContext(ctx, "POST", h.endpoint, bytes.NewReader(reqBody))
+  if err != nil {
+    return nil, fmt.Errorf("Unable to build HTTP provider request: %s", err)
+  }
+  req.Header.Set("Content-Type", "application/json")
+  if h.authToken != "" {
+    req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", h.authToken))
+  }
+
+  resp, err := http.DefaultClient.Do(req)
+  if err != nil {
+    return nil, fmt.Errorf("HTTP provider says: %s", err)
+  }
+  defer resp.Body.Close()
+
+  if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+    return nil, fmt.Errorf("HTTP provider returned HTTP %d", resp.StatusCode)
+  }
+
+  var people []Person
+  if err := json.NewDecoder(resp.Body).Decode(&people); err != nil {
+    return nil, fmt.Errorf("Unable to parse HTTP provider response: %s", err)
+  }
+  return people, nil
+}
+
+// providerAuthToken picks the Vault secret field to use as the provider's
+// API token, keyed by provider name so a single Vault path can hold
+// credentials for every provider deputize knows about.
+func providerAuthToken(config DeputizeConfig, secret map[string]interface{}) (string, error) {
+  var key string
+  switch config.OnCallProvider {
+  case "", "pagerduty":
+    key = "pdAuthToken"
+  case "opsgenie":
+    key = "opsgenieAuthToken"
+  case "http":
+    // Unlike the other providers, HTTPProvider treats a missing token as
+    // unauthenticated rather than misconfigured, since it's meant for
+    // internal on-call sources that may not require auth at all.
+    token, _ := secret["httpProviderAuthToken"].(string)
+    return token, nil
+  default:
+    return "", fmt.Errorf("Unknown OnCallProvider: %s", config.OnCallProvider)
+  }
+  token, ok := secret[key].(string)
+  if !ok {
+    return "", fmt.Errorf("Vault secret is missing %s", key)
+  }
+  return token, nil
+}
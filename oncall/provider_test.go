@@ -0,0 +1,39 @@
+// deputize - Update an LDAP group with info from the PagerDuty API
+// provider_test.go: Tests for the OnCallProvider implementations
+//
+// Copyright 2017 Threat Stack, Inc. All rights reserved.
+// Author: Patrick T. Cable II <pat.cable@threatstack.com>
+
+package oncall
+
+import (
+  "context"
+  "net/http"
+  "net/http/httptest"
+  "testing"
+  "time"
+)
+
+func TestHTTPProviderGetCurrentOnCallRejectsErrorStatus(t *testing.T) {
+  server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    w.WriteHeader(http.StatusUnauthorized)
+  }))
+  defer server.Close()
+
+  provider := &HTTPProvider{endpoint: server.URL}
+  if _, err := provider.GetCurrentOnCall(context.Background(), []string{"primary"}, 12*time.Hour); err == nil {
+    t.Fatal("expected an error for a non-2xx response, got nil")
+  }
+}
+
+func TestOpsGenieProviderGetCurrentOnCallRejectsErrorStatus(t *testing.T) {
+  server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    w.WriteHeader(http.StatusInternalServerError)
+  }))
+  defer server.Close()
+
+  provider := &OpsGenieProvider{apiKey: "fake", baseURLOverride: server.URL}
+  if _, err := provider.GetCurrentOnCall(context.Background(), []string{"primary"}, 12*time.Hour); err == nil {
+    t.Fatal("expected an error for a non-2xx response, got nil")
+  }
+}
@@ -0,0 +1,138 @@
+// deputize - Update an LDAP group with info from the PagerDuty API
+// state.go: Persistent sync state, for drift detection and notify de-dup
+//
+// Copyright 2017 Threat Stack, Inc. All rights reserved.
+// Author: Patrick T. Cable II <pat.cable@threatstack.com>
+
+package oncall
+
+import (
+  "crypto/sha256"
+  "encoding/hex"
+  "encoding/json"
+  "fmt"
+  vault "github.com/hashicorp/vault/api"
+  "io/ioutil"
+  "os"
+  "strings"
+  "time"
+)
+
+// SyncState records what the last successful sync did, so the next run can
+// tell whether LDAP has been mutated out-of-band, or whether it still owes
+// a notification that failed to send last time.
+type SyncState struct {
+  Timestamp time.Time `json:"timestamp"`
+  ScheduleUids map[string][]string `json:"schedule_uids"`
+  ConfigHash string `json:"config_hash"`
+  NotifySucceeded bool `json:"notify_succeeded"`
+}
+
+// StateStore persists and retrieves a SyncState. Load returns a nil state
+// (with no error) when nothing has been saved yet.
+type StateStore interface {
+  Load() (*SyncState, error)
+  Save(state *SyncState) error
+}
+
+// NewStateStore builds the StateStore selected by config.StateBackend
+// ("file", the default, or "vault").
+func NewStateStore(config DeputizeConfig, vaultClient *vault.Client) (StateStore, error) {
+  switch config.StateBackend {
+  case "", "file":
+    path := config.StateFile
+    if path == "" {
+      path = "deputize-state.json"
+    }
+    return &FileStateStore{path: path}, nil
+  case "vault":
+    return &VaultStateStore{client: vaultClient, path: config.VaultSecretPath + "/state"}, nil
+  default:
+    return nil, fmt.Errorf("Unknown StateBackend: %s", config.StateBackend)
+  }
+}
+
+// FileStateStore persists SyncState as a JSON file on local disk.
+type FileStateStore struct {
+  path string
+}
+
+// Load - see StateStore
+func (f *FileStateStore) Load() (*SyncState, error) {
+  data, err := ioutil.ReadFile(f.path)
+  if err != nil {
+    if os.IsNotExist(err) {
+      return nil, nil
+    }
+    return nil, fmt.Errorf("Unable to read state file %s: %s", f.path, err)
+  }
+  var state SyncState
+  if err := json.Unmarshal(data, &state); err != nil {
+    return nil, fmt.Errorf("Unable to parse state file %s: %s", f.path, err)
+  }
+  return &state, nil
+}
+
+// Save - see StateStore
+func (f *FileStateStore) Save(state *SyncState) error {
+  data, err := json.Marshal(state)
+  if err != nil {
+    return fmt.Errorf("Unable to marshal state: %s", err)
+  }
+  if err := ioutil.WriteFile(f.path, data, 0600); err != nil {
+    return fmt.Errorf("Unable to write state file %s: %s", f.path, err)
+  }
+  return nil
+}
+
+// VaultStateStore persists SyncState in Vault KV, next to deputize's other
+// secrets, so a fleet of deputize instances sharing one Vault also share
+// sync state.
+type VaultStateStore struct {
+  client *vault.Client
+  path string
+}
+
+// Load - see StateStore
+func (v *VaultStateStore) Load() (*SyncState, error) {
+  secret, err := v.client.Logical().Read(v.path)
+  if err != nil {
+    return nil, fmt.Errorf("Unable to read state from Vault: %s", err)
+  }
+  if secret == nil || secret.Data["state"] == nil {
+    return nil, nil
+  }
+  raw, ok := secret.Data["state"].(string)
+  if !ok {
+    return nil, fmt.Errorf("Vault state at %s is not a string", v.path)
+  }
+  var state SyncState
+  if err := json.Unmarshal([]byte(raw), &state); err != nil {
+    return nil, fmt.Errorf("Unable to parse Vault state: %s", err)
+  }
+  return &state, nil
+}
+
+// Save - see StateStore
+func (v *VaultStateStore) Save(state *SyncState) error {
+  data, err := json.Marshal(state)
+  if err != nil {
+    return fmt.Errorf("Unable to marshal state: %s", err)
+  }
+  _, err = v.client.Logical().Write(v.path, map[string]interface{}{"state": string(data)})
+  if err != nil {
+    return fmt.Errorf("Unable to write state to Vault: %s", err)
+  }
+  return nil
+}
+
+// configHash fingerprints the parts of DeputizeConfig that affect what a
+// sync resolves, so a stale state file left behind after a config change
+// (new schedules, a different group) doesn't get compared against
+// members it no longer describes.
+func configHash(config DeputizeConfig) string {
+  h := sha256.New()
+  fmt.Fprintf(h, "%s|%s|%s|%s", config.OnCallGroupDN, config.MemberAttribute,
+    strings.Join(config.OnCallSchedules,","), config.OnCallProvider)
+  return hex.EncodeToString(h.Sum(nil))
+}